@@ -2,15 +2,26 @@
 package httpterm
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"net/textproto"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const (
@@ -24,6 +35,29 @@ const (
 // ErrClosing indicating that operation is not allowed as server is closing
 var ErrClosing = errors.New("server closing")
 
+// ConnInfo carries metadata about a connection at the time a
+// ServerConnStateFunc callback fires.
+type ConnInfo struct {
+	// BytesRead is the total number of bytes read from the connection since
+	// it was accepted.
+	BytesRead int64
+
+	// RemoteAddr is the connection's remote address.
+	RemoteAddr net.Addr
+
+	// IdleDuration is how long the connection was idle immediately before
+	// this transition. It is zero for a connection's first request, since
+	// the connection has not yet been through an idle state to measure.
+	IdleDuration time.Duration
+
+	// RequestCount is the number of requests read from this connection so
+	// far, including the one starting with this transition.
+	RequestCount int
+}
+
+// ServerConnStateFunc is the type of Server.ConnStateFunc.
+type ServerConnStateFunc func(c net.Conn, state http.ConnState, info ConnInfo)
+
 // Server embeds http.Server and provides additional functionality.
 // All the http.Server can be accessed directly and behaves as decribed in
 // the original docs at http://golang.org/pkg/net/http/#Server.
@@ -52,20 +86,119 @@ type Server struct {
 	// IdleTimeout defines for how long connection can be idle between requests.
 	IdleTimeout time.Duration
 
+	// MinHeaderBytesPerSecond, if non-zero, enforces a minimum average read
+	// rate while reading request headers (StateHead). If the rate drops
+	// below this floor for longer than a short grace period, the
+	// connection is aborted. This complements HeadReadTimeout: a generous
+	// absolute deadline alone can still be held open indefinitely by a
+	// Slowloris-style client that trickles one byte just before each
+	// deadline reset.
+	MinHeaderBytesPerSecond int64
+
+	// MinBodyBytesPerSecond is the equivalent of MinHeaderBytesPerSecond
+	// for the request body, complementing BodyReadTimeout.
+	MinBodyBytesPerSecond int64
+
 	// NewAsActive prevents new connections from being idle before sending
 	// first request. If set, new connections will have HeadReadTimeout applied.
 	// If server is behind some proxy or a load balancer which maintains
 	// a permanent connection, setting up this flag is not recommended.
 	NewAsActive bool
 
+	// ConnStateFunc, if set, is called on every StateHead transition with
+	// metadata the bare ConnState hook doesn't carry: bytes read so far,
+	// remote address, how long the connection was idle beforehand and how
+	// many requests it has served. Unlike ConnState, Serve never overwrites
+	// this field.
+	ConnStateFunc ServerConnStateFunc
+
+	// MaxConcurrentConnections limits how many connections the server will
+	// hold open at once. A value of 0 means no limit.
+	MaxConcurrentConnections int
+
+	// MaxConnectionsPerIP limits how many connections a single remote IP
+	// may hold open at once. A value of 0 means no limit.
+	//
+	// On a unix domain socket listener, RemoteAddr is normally empty for
+	// every client, so all connections share one bucket and this behaves
+	// like an additional MaxConcurrentConnections rather than a per-client
+	// limit; it is only meaningful on network listeners that populate
+	// RemoteAddr with a distinct host per client.
+	//
+	// An h2c connection (see EnableHTTP2) stops counting against this
+	// limit and MaxConcurrentConnections the moment it upgrades, even
+	// though it goes on serving multiplexed streams afterward: h2c.NewHandler
+	// hijacks the connection to serve it, which untracks it the same way a
+	// regular hijack does (see updateConnState). A client can exceed either
+	// limit by cycling h2c connections.
+	MaxConnectionsPerIP int
+
+	// AcceptWait bounds how long a newly accepted connection waits for a
+	// connection slot to free up once MaxConcurrentConnections or
+	// MaxConnectionsPerIP is hit, before it is rejected. The wait happens
+	// off the accept loop (see rtListener.handleAccepted), so it does not
+	// hold up other connections. A value of 0 rejects immediately without
+	// waiting.
+	AcceptWait time.Duration
+
+	// RejectResponse, if set, is written to a connection rejected for
+	// exceeding MaxConcurrentConnections or MaxConnectionsPerIP before it
+	// is closed, e.g. a pre-canned "503 Service Unavailable" response.
+	RejectResponse []byte
+
+	// EnableHTTP2 turns on HTTP/2 support: h2c for cleartext listeners, and
+	// ALPN negotiation of "h2" for TLS ones. The rtConn-based timeout model
+	// this package otherwise relies on doesn't fit HTTP/2, where a single
+	// conn multiplexes many streams and never transitions back through
+	// http.StateIdle between requests; once a connection is recognized as
+	// HTTP/2 (see isHTTP2Conn), per-state read deadlines and
+	// MinHeaderBytesPerSecond/MinBodyBytesPerSecond enforcement are skipped
+	// for it, and liveness is governed instead by an http2.Server's own
+	// IdleTimeout, derived from Server.IdleTimeout.
+	EnableHTTP2 bool
+
+	// HandshakeTimeout bounds the TLS handshake rtListener runs on each
+	// accepted connection to probe ALPN for "h2" when EnableHTTP2 is set.
+	// It runs off the accept loop (see rtListener.Accept), but is still
+	// bounded so a client that stalls mid-handshake doesn't tie up that
+	// connection's goroutine forever. A value of 0 uses
+	// defaultHandshakeTimeout. Unused when EnableHTTP2 is false.
+	HandshakeTimeout time.Duration
+
+	// MaxConcurrentHandshakes bounds how many of the handshakes described
+	// under HandshakeTimeout rtListener will run at once. Those handshakes
+	// happen in a goroutine per raw connection, ahead of
+	// MaxConcurrentConnections/MaxConnectionsPerIP ever getting a chance to
+	// reject them, so without a separate cap a burst of raw TCP connections
+	// could still spend unbounded CPU on concurrent handshakes. A value of
+	// 0 uses defaultMaxConcurrentHandshakes. Unused when EnableHTTP2 is
+	// false.
+	MaxConcurrentHandshakes int
+
 	listener *rtListener
 
 	lock    sync.Mutex
 	closing bool
 
+	// closeDeadline is the read deadline applied to idle/new connections
+	// while closing is true. Close sets it to a fixed point shortly in the
+	// future; Shutdown leaves it zero so those connections block until ctx
+	// governs them instead.
+	closeDeadline time.Time
+
 	// conns is a map of connections which indicates whether connection is active,
 	// i.e. there a request being processed (including header handling)
 	conns map[net.Conn]bool
+
+	// connState holds the last known http.ConnState (or StateHead) of each
+	// tracked connection, for Stats.
+	connState map[net.Conn]http.ConnState
+
+	// connIP and ipCounts track, for each tracked connection, its remote IP
+	// and how many connections are currently open from it, enforcing
+	// MaxConnectionsPerIP and feeding Stats.
+	connIP   map[net.Conn]string
+	ipCounts map[string]int
 }
 
 // Serve behaves as http.Server.Serve.
@@ -75,10 +208,18 @@ type Server struct {
 // all connections are closed or hijacked.
 func (s *Server) Serve(l net.Listener) (pending <-chan bool, err error) {
 	s.conns = make(map[net.Conn]bool)
+	s.connState = make(map[net.Conn]http.ConnState)
+	s.connIP = make(map[net.Conn]string)
+	s.ipCounts = make(map[string]int)
 
 	oldConnState := s.ConnState
 	newConnState := func(c net.Conn, state http.ConnState) {
 		s.updateConnState(c, state)
+
+		if state == StateHead && s.ConnStateFunc != nil {
+			s.ConnStateFunc(c, state, s.connInfo(c))
+		}
+
 		// Pass to original handler
 		if oldConnState != nil {
 			oldConnState(c, state)
@@ -87,11 +228,22 @@ func (s *Server) Serve(l net.Listener) (pending <-chan bool, err error) {
 
 	s.ConnState = newConnState
 
+	if s.EnableHTTP2 {
+		if err = s.configureHTTP2(); err != nil {
+			pending = noPending
+			return
+		}
+	}
+
 	// Wrap with custom listener
 	s.listener = &rtListener{
-		Listener:    l,
-		newAsActive: s.NewAsActive,
-		callback:    func(c net.Conn) { newConnState(c, StateHead) },
+		Listener:                l,
+		server:                  s,
+		newAsActive:             s.NewAsActive,
+		detectH2:                s.EnableHTTP2,
+		handshakeTimeout:        s.HandshakeTimeout,
+		maxConcurrentHandshakes: s.MaxConcurrentHandshakes,
+		callback:                func(c net.Conn) { newConnState(c, StateHead) },
 	}
 
 	// Register signal handling for shutdown if requested
@@ -121,6 +273,10 @@ func (s *Server) Serve(l net.Listener) (pending <-chan bool, err error) {
 // ListenAndServe behaves as http.Server.ListenAndServe.
 // See: http://golang.org/pkg/net/http/#Server.ListenAndServe
 //
+// If s.Addr is a unix domain socket address (it starts with "/" or
+// "unix:"), ListenAndServe delegates to ListenAndServeUnix instead of
+// listening on TCP.
+//
 // Along with an error, pending channel is returned which will be closed once
 // all connections are closed or hijacked.
 func (s *Server) ListenAndServe() (pending <-chan bool, err error) {
@@ -130,6 +286,11 @@ func (s *Server) ListenAndServe() (pending <-chan bool, err error) {
 	if addr == "" {
 		addr = ":http"
 	}
+
+	if isUnixAddr(addr) {
+		return s.ListenAndServeUnix()
+	}
+
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return
@@ -138,6 +299,71 @@ func (s *Server) ListenAndServe() (pending <-chan bool, err error) {
 	return s.Serve(ln)
 }
 
+// isUnixAddr reports whether addr names a unix domain socket rather than a
+// TCP address, following the "/path" and "unix:path" conventions.
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, "unix:")
+}
+
+// unixPath strips the optional "unix:" prefix from addr.
+func unixPath(addr string) string {
+	return strings.TrimPrefix(addr, "unix:")
+}
+
+// ListenAndServeUnix listens on the unix domain socket named by s.Addr
+// (a filesystem path, optionally prefixed with "unix:", e.g.
+// "/var/run/app.sock" or "unix:/var/run/app.sock") and serves requests on
+// it as ListenAndServe does for TCP. A stale socket file left behind by a
+// previous instance that is no longer listening is removed before retrying.
+//
+// Along with an error, pending channel is returned which will be closed once
+// all connections are closed or hijacked.
+func (s *Server) ListenAndServeUnix() (pending <-chan bool, err error) {
+	pending = noPending
+
+	path := unixPath(s.Addr)
+	if path == "" {
+		err = errors.New("httpterm: empty unix socket path")
+		return
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil && isAddrInUse(err) {
+		// A socket that still accepts connections belongs to a live
+		// instance; leave it alone and report the original error.
+		if c, dialErr := net.Dial("unix", path); dialErr == nil {
+			c.Close()
+			return
+		}
+
+		// The socket file may be left over from a previous instance that
+		// is no longer running; remove it and retry once.
+		os.Remove(path)
+		ln, err = net.Listen("unix", path)
+	}
+	if err != nil {
+		return
+	}
+
+	return s.Serve(ln)
+}
+
+// isAddrInUse reports whether err is a "bind: address already in use"
+// error, which for a unix socket usually means a stale socket file.
+func isAddrInUse(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return false
+	}
+
+	var sysErr *os.SyscallError
+	if !errors.As(opErr.Err, &sysErr) {
+		return false
+	}
+
+	return errors.Is(sysErr.Err, syscall.EADDRINUSE)
+}
+
 // ListenAndServeTLS behaves as http.Server.ListenAndServeTLS.
 // See: http://golang.org/pkg/net/http/#Server.ListenAndServeTLS
 //
@@ -151,7 +377,11 @@ func (s *Server) ListenAndServeTLS(certFile, keyFile string) (pending <-chan boo
 		*config = *s.TLSConfig
 	}
 	if config.NextProtos == nil {
-		config.NextProtos = []string{"http/1.1"}
+		if s.EnableHTTP2 {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		} else {
+			config.NextProtos = []string{"http/1.1"}
+		}
 	}
 
 	config.Certificates = make([]tls.Certificate, 1)
@@ -173,6 +403,264 @@ func (s *Server) ListenAndServeTLS(certFile, keyFile string) (pending <-chan boo
 	return s.Serve(tls.NewListener(ln, config))
 }
 
+// configureHTTP2 builds the http2.Server used when EnableHTTP2 is set,
+// deriving its IdleTimeout from Server.IdleTimeout, and wires it into
+// s.Server and s.Handler. It must be called before Serve starts accepting
+// connections.
+func (s *Server) configureHTTP2() error {
+	h2s := &http2.Server{
+		IdleTimeout: s.IdleTimeout,
+	}
+
+	// Registers h2s as the handler for TLS connections that negotiate "h2"
+	// over ALPN; net/http dispatches to it directly once
+	// rtListener.Accept has handed back the bare *tls.Conn for such
+	// connections (see rtListener.handleAccepted's detectH2 handling).
+	if err := http2.ConfigureServer(&s.Server, h2s); err != nil {
+		return err
+	}
+
+	// Also accept h2c: cleartext HTTP/2, either via prior knowledge or the
+	// Upgrade header, detected by h2c.NewHandler at the request layer once
+	// it sees the "PRI * HTTP/2.0" preface parsed as a regular request.
+	//
+	// h2c.NewHandler hijacks the underlying conn to serve it, which takes
+	// it out of s.conns (see updateConnState's StateHijacked case) before
+	// its streams are actually done. The http2 package has no exported way
+	// to force such a hijacked connection to drain, so Close/Shutdown
+	// can't wait for h2c traffic the way they do for everything else;
+	// h2s.IdleTimeout is what bounds an otherwise-idle h2c connection's
+	// lifetime.
+	//
+	// markH2CUpgrade wraps the ResponseWriter for exactly the requests
+	// h2c.NewHandler itself will hijack to upgrade, so that hijack marks
+	// rtConn as h2c (see rtConn.hijackedH2C). A handler further down the
+	// chain may also hijack, for reasons of its own (e.g. websockets); that
+	// must not be mistaken for an h2c upgrade, so the marking has to happen
+	// at this specific hijack rather than by guessing from StateHijacked
+	// alone.
+	s.Handler = markH2CUpgrade(h2c.NewHandler(s.handler(), h2s))
+
+	return nil
+}
+
+// isH2CUpgradeRequest mirrors h2c.NewHandler's own (unexported) detection
+// of a request it will hijack to upgrade to cleartext HTTP/2: either prior
+// knowledge (RFC 7540 Section 3.4) or the Upgrade header (Section 3.2).
+func isH2CUpgradeRequest(r *http.Request) bool {
+	if r.Method == "PRI" && len(r.Header) == 0 && r.URL.Path == "*" && r.Proto == "HTTP/2.0" {
+		return true
+	}
+
+	return httpguts.HeaderValuesContainsToken(r.Header[textproto.CanonicalMIMEHeaderKey("Upgrade")], "h2c") &&
+		httpguts.HeaderValuesContainsToken(r.Header[textproto.CanonicalMIMEHeaderKey("Connection")], "HTTP2-Settings")
+}
+
+// markH2CUpgrade wraps h, which must be h2c.NewHandler's handler, so that
+// h2c.NewHandler's own hijack to upgrade a connection marks rtConn
+// accordingly (see rtConn.hijackedH2C) without also catching a hijack some
+// other handler further down the chain performs for an unrelated reason.
+func markH2CUpgrade(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isH2CUpgradeRequest(r) {
+			w = h2cUpgradeResponseWriter{w}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// h2cUpgradeResponseWriter marks the conn it hijacks as upgraded to h2c;
+// see markH2CUpgrade.
+type h2cUpgradeResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w h2cUpgradeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		if rc, ok := conn.(*rtConn); ok {
+			rc.hijackedH2C = true
+		}
+	}
+	return conn, rw, err
+}
+
+// handler returns s.Handler, falling back to http.DefaultServeMux as
+// net/http.Server.Serve itself does, since h2c.NewHandler needs a concrete
+// handler to wrap.
+func (s *Server) handler() http.Handler {
+	if s.Handler != nil {
+		return s.Handler
+	}
+	return http.DefaultServeMux
+}
+
+// isHTTP2Conn reports whether c is running HTTP/2: either a TLS connection
+// that has negotiated "h2" over ALPN, bypassing rtConn entirely (see
+// Accept), or a cleartext connection h2c.NewHandler hijacked to upgrade to
+// h2c (see markH2CUpgrade), which leaves it wrapped in rtConn but marks it
+// so. Either way, per-state read deadlines and
+// throughput floors, which would otherwise fight with http2.Server's own
+// IdleTimeout, must be skipped for them. This is only used to skip
+// re-arming the read deadline (see updateConnState); it isn't a reliable way
+// to detect a hijacked h2c conn in general, since h2c.NewHandler may hand
+// http2.Server's ConnState hook a wrapper conn rather than c itself -
+// rtConn.SetReadDeadline, not this function, is what actually guarantees
+// deadlines stay off for it.
+func isHTTP2Conn(c net.Conn) bool {
+	if tc, ok := c.(*tls.Conn); ok {
+		return tc.ConnectionState().NegotiatedProtocol == "h2"
+	}
+
+	rc, ok := c.(*rtConn)
+	return ok && rc.hijackedH2C
+}
+
+// listenFDsStart is the first inherited file descriptor number under the
+// systemd socket-activation protocol (fds 0-2 are stdin/stdout/stderr).
+const listenFDsStart = 3
+
+// ListenFDs adopts listeners passed down by a parent process using the
+// systemd socket-activation protocol: LISTEN_PID must match the current
+// process and LISTEN_FDS gives the number of inherited sockets, starting at
+// file descriptor 3. This is the same protocol implemented by systemd,
+// einhorn and similar socket-passing supervisors, making it usable for
+// zero-downtime restarts without depending on systemd itself.
+func ListenFDs() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("httpterm: LISTEN_PID not set for this process")
+	}
+
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, fmt.Errorf("httpterm: LISTEN_FDS not set or zero")
+	}
+
+	listeners := make([]net.Listener, 0, nfds)
+	for i := 0; i < nfds; i++ {
+		fd := uintptr(listenFDsStart + i)
+		file := os.NewFile(fd, fmt.Sprintf("listen_fd_%d", fd))
+
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// ServeFDs adopts listeners inherited via ListenFDs and serves requests on
+// all of them, enabling zero-downtime restarts: a new process can be
+// started with the listening sockets of the old one, bind-free, and take
+// over once ready.
+//
+// Along with an error, pending channel is returned which will be closed once
+// all connections are closed or hijacked.
+func (s *Server) ServeFDs() (pending <-chan bool, err error) {
+	pending = noPending
+
+	listeners, err := ListenFDs()
+	if err != nil {
+		return
+	}
+
+	var ln net.Listener = listeners[0]
+	if len(listeners) > 1 {
+		ln = newFanInListener(listeners)
+	}
+
+	return s.Serve(ln)
+}
+
+// fanInListener merges Accept calls from several listeners into one, so a
+// single Server can serve all of them through its usual rtListener
+// bookkeeping. Since Accept reports a single terminal error for the whole
+// group (matching net.Listener's contract, and what rtListener.acceptLoop
+// expects), any one listener failing on its own closes the rest too; see
+// acceptLoop.
+type fanInListener struct {
+	listeners []net.Listener
+	accepted  chan fanInAccept
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type fanInAccept struct {
+	conn net.Conn
+	err  error
+}
+
+func newFanInListener(listeners []net.Listener) *fanInListener {
+	l := &fanInListener{
+		listeners: listeners,
+		accepted:  make(chan fanInAccept),
+		done:      make(chan struct{}),
+	}
+
+	for _, ln := range listeners {
+		go l.acceptLoop(ln)
+	}
+
+	return l
+}
+
+func (l *fanInListener) acceptLoop(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+
+		select {
+		case l.accepted <- fanInAccept{c, err}:
+		case <-l.done:
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+
+		if err != nil {
+			// ln failed on its own, independently of Close (e.g. a fd it
+			// was handed got closed out from under it). Whoever is reading
+			// l.accepted (rtListener.acceptLoop) treats this as the merged
+			// listener being entirely done and stops consuming it for
+			// good, so every other acceptLoop(ln) goroutine would
+			// otherwise block forever trying to deliver its own next
+			// result and leak along with its listener. Close unwinds them
+			// all the same way an explicit Close would.
+			l.Close()
+			return
+		}
+	}
+}
+
+func (l *fanInListener) Accept() (net.Conn, error) {
+	a := <-l.accepted
+	return a.conn, a.err
+}
+
+func (l *fanInListener) Close() error {
+	var err error
+
+	l.closeOnce.Do(func() {
+		close(l.done)
+		for _, ln := range l.listeners {
+			if e := ln.Close(); e != nil {
+				err = e
+			}
+		}
+	})
+
+	return err
+}
+
+func (l *fanInListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
+
 // The following timeout will be applied to idle connections on server shutdown
 var waitOnClose = 100 * time.Millisecond
 
@@ -188,26 +676,105 @@ func (s *Server) Close() error {
 		return ErrClosing
 	}
 
-	if err := s.listener.Close(); err != nil {
+	if err := s.beginClosing(); err != nil {
 		return err
 	}
 
-	s.SetKeepAlivesEnabled(false)
-	s.closing = true
-
 	// Set a predefined deadline for all inactive connections (new or idle).
 	// If during this period state changes to active, request will be processed
 	// with regular request timeout, otherwise connection will be closed.
-	deadline := time.Now().Add(waitOnClose)
+	s.closeDeadline = time.Now().Add(waitOnClose)
 	for c, active := range s.conns {
 		if !active {
-			c.SetReadDeadline(deadline)
+			c.SetReadDeadline(s.closeDeadline)
 		}
 	}
 
 	return nil
 }
 
+// Shutdown gracefully shuts down the server: it stops accepting new
+// connections, disables keep-alives, then waits for all connections tracked
+// in s.conns to finish, polling until either none remain or ctx is done. Any
+// connections still around once ctx is done are closed forcibly. Unlike
+// Close, idle connections are not given a fixed deadline of their own; ctx
+// alone governs how long Shutdown waits.
+//
+// Note that, same as h2c.NewHandler's own caveat, hijacked h2c connections
+// (see configureHTTP2) aren't tracked in s.conns and so aren't waited on
+// here; only their h2s.IdleTimeout bounds them.
+//
+// It is safe to call Shutdown concurrently with Serve's pending channel;
+// both observe the same underlying conn bookkeeping.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	if s.closing {
+		s.lock.Unlock()
+		return ErrClosing
+	}
+
+	if err := s.beginClosing(); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	// Cancel any deadline previously applied to idle/new connections so
+	// they block on ctx instead of a fixed timeout.
+	for c, active := range s.conns {
+		if !active {
+			c.SetReadDeadline(time.Time{})
+		}
+	}
+	s.lock.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.connCount() == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.closeAllConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// beginClosing closes the listener and marks the server as closing. Caller
+// must hold s.lock and have already checked s.closing is false.
+func (s *Server) beginClosing() error {
+	if err := s.listener.Close(); err != nil {
+		return err
+	}
+
+	s.SetKeepAlivesEnabled(false)
+	s.closing = true
+
+	return nil
+}
+
+// shutdownPollInterval is how often Shutdown checks whether all connections
+// have closed.
+var shutdownPollInterval = 50 * time.Millisecond
+
+func (s *Server) connCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) closeAllConns() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
 // Closed pending channel
 var noPending <-chan bool = func() chan bool {
 	ch := make(chan bool)
@@ -258,36 +825,267 @@ func (s *Server) updateConnState(c net.Conn, state http.ConnState) {
 		s.conns[c] = false
 	case http.StateClosed, http.StateHijacked:
 		delete(s.conns, c)
+		delete(s.connState, c)
+		if ip, ok := s.connIP[c]; ok {
+			delete(s.connIP, c)
+			s.ipCounts[ip]--
+			if s.ipCounts[ip] <= 0 {
+				delete(s.ipCounts, ip)
+			}
+		}
 		s.listener.wg.Done()
 	case StateHead:
 		s.conns[c] = true
 	}
 
+	if state != http.StateClosed && state != http.StateHijacked {
+		s.connState[c] = state
+	}
+
 	if state == http.StateIdle {
 		if c, ok := c.(*rtConn); ok {
 			c.idle()
 		}
 	}
 
+	if state == StateHead || state == http.StateActive {
+		if c, ok := c.(*rtConn); ok {
+			c.enterRateWindow(state, s.MinHeaderBytesPerSecond, s.MinBodyBytesPerSecond)
+		}
+	}
+
+	// TLS HTTP/2 connections are handed to net/http (and from there to
+	// http2.Server) unwrapped from rtConn, and h2c ones are marked on their
+	// rtConn once hijacked (see isHTTP2Conn); http2.Server's own IdleTimeout
+	// governs their liveness instead, so leave their read deadline alone.
+	if isHTTP2Conn(c) {
+		return
+	}
+
 	// Update timeout if not closing or new request
 	if !s.closing || state == StateHead || state == http.StateActive {
 		if t := s.getTimeout(state); t != 0 {
 			c.SetReadDeadline(time.Now().Add(t))
 		}
 	} else {
-		c.SetReadDeadline(time.Now().Add(waitOnClose))
+		c.SetReadDeadline(s.closeDeadline)
+	}
+}
+
+// connInfo gathers the ConnInfo for c to be passed to Server.ConnStateFunc.
+func (s *Server) connInfo(c net.Conn) ConnInfo {
+	info := ConnInfo{RemoteAddr: c.RemoteAddr()}
+
+	if rc, ok := c.(*rtConn); ok {
+		info.BytesRead = rc.bytesRead
+		info.RequestCount = rc.requestCount
+		if !rc.idleSince.IsZero() {
+			info.IdleDuration = time.Since(rc.idleSince)
+		}
+	}
+
+	return info
+}
+
+// acceptPollInterval is how often a blocked Accept rechecks for a free
+// connection slot while within AcceptWait.
+var acceptPollInterval = 50 * time.Millisecond
+
+// admit waits, bounded by AcceptWait, for a connection slot to become
+// available under MaxConcurrentConnections/MaxConnectionsPerIP, reserving
+// it for c as soon as one is free. It reports whether c was admitted.
+func (s *Server) admit(c net.Conn) bool {
+	if s.tryReserve(c) {
+		return true
+	}
+
+	if s.AcceptWait <= 0 {
+		return false
 	}
+
+	deadline := time.Now().Add(s.AcceptWait)
+	ticker := time.NewTicker(acceptPollInterval)
+	defer ticker.Stop()
+
+	for time.Now().Before(deadline) {
+		<-ticker.C
+		if s.tryReserve(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tryReserve reserves a connection slot for c if the configured limits
+// allow it, registering c the same way updateConnState would for
+// http.StateNew so the reservation is immediately visible to the next
+// Accept call.
+func (s *Server) tryReserve(c net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.MaxConcurrentConnections > 0 && len(s.conns) >= s.MaxConcurrentConnections {
+		return false
+	}
+
+	ip := connIP(c)
+	if s.MaxConnectionsPerIP > 0 && s.ipCounts[ip] >= s.MaxConnectionsPerIP {
+		return false
+	}
+
+	s.conns[c] = false
+	s.connIP[c] = ip
+	s.ipCounts[ip]++
+
+	return true
+}
+
+// reject writes s.RejectResponse, if set, to c and closes it.
+func (s *Server) reject(c net.Conn) {
+	if len(s.RejectResponse) > 0 {
+		c.SetWriteDeadline(time.Now().Add(waitOnClose))
+		c.Write(s.RejectResponse)
+	}
+
+	c.Close()
+}
+
+// abandon undoes tryReserve's bookkeeping for c and closes it. It's used
+// when a connection was admitted but the listener stopped accepting before
+// it could be handed to http.Server (see rtListener.handleAccepted), so it
+// will never reach updateConnState's usual StateClosed cleanup.
+func (s *Server) abandon(c net.Conn) {
+	s.lock.Lock()
+	delete(s.conns, c)
+	if ip, ok := s.connIP[c]; ok {
+		delete(s.connIP, c)
+		s.ipCounts[ip]--
+		if s.ipCounts[ip] <= 0 {
+			delete(s.ipCounts, ip)
+		}
+	}
+	s.lock.Unlock()
+
+	c.Close()
+}
+
+// connIP returns the remote IP of c, without the port, falling back to the
+// raw remote address string if it can't be split. On a unix domain socket
+// listener this is normally empty for every connection (see
+// MaxConnectionsPerIP), collapsing them all into a single bucket.
+func connIP(c net.Conn) string {
+	addr := c.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// IPCount is one entry of Stats.TopIPs.
+type IPCount struct {
+	IP    string
+	Count int
+}
+
+// Stats summarizes the server's current connection load, as returned by
+// Server.Stats.
+type Stats struct {
+	// Total is the number of connections currently tracked by the server.
+	// An h2c connection (see EnableHTTP2) stops being tracked, and so stops
+	// counting here, the moment it upgrades, even though it goes on serving
+	// multiplexed streams afterward (see MaxConnectionsPerIP).
+	Total int
+
+	// ByState breaks Total down by each connection's last known state.
+	ByState map[http.ConnState]int
+
+	// TopIPs lists the remote IPs currently holding the most connections
+	// open, most first.
+	TopIPs []IPCount
+}
+
+// Stats reports the server's current connection load, so operators can
+// observe pressure from MaxConcurrentConnections/MaxConnectionsPerIP (or
+// just from traffic in general) without an external reverse proxy. topIPs
+// bounds how many entries Stats.TopIPs holds; topIPs <= 0 returns all of
+// them.
+func (s *Server) Stats(topIPs int) Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := Stats{
+		Total:   len(s.conns),
+		ByState: make(map[http.ConnState]int, len(s.connState)),
+	}
+
+	for _, state := range s.connState {
+		stats.ByState[state]++
+	}
+
+	counts := make([]IPCount, 0, len(s.ipCounts))
+	for ip, n := range s.ipCounts {
+		counts = append(counts, IPCount{IP: ip, Count: n})
+	}
+
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Count > counts[j].Count })
+
+	if topIPs > 0 && len(counts) > topIPs {
+		counts = counts[:topIPs]
+	}
+	stats.TopIPs = counts
+
+	return stats
+}
+
+// defaultHandshakeTimeout bounds the TLS handshake rtListener runs to probe
+// ALPN for "h2" (see EnableHTTP2) when Server.HandshakeTimeout is left at
+// its zero value.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// defaultMaxConcurrentHandshakes bounds how many of those handshakes
+// rtListener runs at once when Server.MaxConcurrentHandshakes is left at
+// its zero value.
+const defaultMaxConcurrentHandshakes = 256
+
+// acceptResult is one net/http-visible outcome of rtListener's background
+// accept loop: either a conn ready to be handed to http.Server.Serve, or
+// the terminal error from the underlying Listener.Accept.
+type acceptResult struct {
+	conn net.Conn
+	err  error
 }
 
 type rtListener struct {
 	net.Listener
 
-	newAsActive bool             // set new connections as active
-	callback    func(c net.Conn) // data callback
+	server *Server
+
+	newAsActive             bool             // set new connections as active
+	detectH2                bool             // probe TLS ALPN for "h2" and hand it to net/http unwrapped
+	handshakeTimeout        time.Duration    // bounds the ALPN-probing handshake when detectH2 is set
+	maxConcurrentHandshakes int              // bounds concurrent in-flight handshakes when detectH2 is set
+	callback                func(c net.Conn) // data callback
 
 	wg sync.WaitGroup
+
+	acceptOnce   sync.Once
+	results      chan acceptResult
+	closing      chan struct{} // closed once acceptLoop stops, so in-flight handleAccepted calls can bail out
+	handshakeSem chan struct{} // bounds concurrent in-flight TLS handshakes, see maxConcurrentHandshakes
 }
 
+// Accept implements net.Listener for net/http's single-threaded accept
+// loop. It never itself runs a TLS handshake or blocks on admission: both
+// are done by handleAccepted in a goroutine per raw connection, so one
+// slow or hostile connection can't starve every other connection's Accept
+// call.
 func (l *rtListener) Accept() (c net.Conn, err error) {
 	l.wg.Add(1)
 	defer func() {
@@ -296,12 +1094,107 @@ func (l *rtListener) Accept() (c net.Conn, err error) {
 		}
 	}()
 
-	c, err = l.Listener.Accept()
-	if c != nil {
-		c = &rtConn{c, l.newAsActive, l.callback}
+	l.acceptOnce.Do(func() {
+		// Left unbuffered: handleAccepted's select against l.closing (see
+		// below) relies on a send only ever succeeding while a caller is
+		// actually blocked reading it, so that once acceptLoop has
+		// delivered its terminal error and closed l.closing, no admitted
+		// connection can still slip into the channel with nothing left to
+		// drain it.
+		l.results = make(chan acceptResult)
+		l.closing = make(chan struct{})
+		maxHandshakes := l.maxConcurrentHandshakes
+		if maxHandshakes <= 0 {
+			maxHandshakes = defaultMaxConcurrentHandshakes
+		}
+		l.handshakeSem = make(chan struct{}, maxHandshakes)
+		go l.acceptLoop()
+	})
+
+	res := <-l.results
+	return res.conn, res.err
+}
+
+// acceptLoop repeatedly calls the underlying Listener's Accept and hands
+// each raw connection off to its own goroutine (see handleAccepted), so
+// the only thing this loop ever blocks on is waiting for the next
+// connection to arrive. It runs for the lifetime of the listener, stopping
+// once Listener.Accept returns its terminal error (e.g. the listener was
+// closed), at which point it closes l.closing so any handleAccepted calls
+// still in flight know no further Accept call will ever read their result.
+func (l *rtListener) acceptLoop() {
+	for {
+		raw, err := l.Listener.Accept()
+		if err != nil {
+			l.results <- acceptResult{err: err}
+			close(l.closing)
+			return
+		}
+
+		go l.handleAccepted(raw)
 	}
+}
 
-	return
+// handleAccepted runs the TLS handshake (if any) and admission check for
+// one accepted connection, off the shared accept loop, and delivers the
+// result to Accept. A connection that fails its handshake or is rejected
+// for exceeding MaxConcurrentConnections/MaxConnectionsPerIP is simply
+// closed here without ever producing a result. If l.closing fires first
+// (the listener stopped accepting while this call was still in flight),
+// any admission already reserved for raw is abandoned instead of blocking
+// forever on a result nothing will ever read.
+func (l *rtListener) handleAccepted(raw net.Conn) {
+	if l.detectH2 {
+		if tc, ok := raw.(*tls.Conn); ok {
+			l.handshakeSem <- struct{}{}
+			timeout := l.handshakeTimeout
+			if timeout <= 0 {
+				timeout = defaultHandshakeTimeout
+			}
+			tc.SetDeadline(time.Now().Add(timeout))
+			err := tc.Handshake()
+			tc.SetDeadline(time.Time{})
+			<-l.handshakeSem
+			if err != nil {
+				raw.Close()
+				return
+			}
+
+			if tc.ConnectionState().NegotiatedProtocol == "h2" {
+				// Hand the bare *tls.Conn straight to net/http: it
+				// type-asserts the conn it accepted to dispatch h2
+				// connections to http2.Server, which rtConn would
+				// defeat. Such connections skip rtConn's per-state
+				// deadlines entirely (see updateConnState).
+				if l.server.admit(tc) {
+					select {
+					case l.results <- acceptResult{conn: tc}:
+					case <-l.closing:
+						l.server.abandon(tc)
+					}
+					return
+				}
+				l.server.reject(tc)
+				return
+			}
+		}
+	}
+
+	rc := &rtConn{Conn: raw, active: l.newAsActive, callback: l.callback}
+
+	if l.server.admit(rc) {
+		select {
+		case l.results <- acceptResult{conn: rc}:
+		case <-l.closing:
+			l.server.abandon(rc)
+		}
+		return
+	}
+
+	// Over a configured limit and AcceptWait didn't free up a slot in
+	// time: reject this one; acceptLoop is already free to hand off the
+	// next accepted conn.
+	l.server.reject(rc)
 }
 
 // rtConn is a net.Conn that sets read deadlines for idle and active state.
@@ -311,16 +1204,94 @@ type rtConn struct {
 
 	active   bool             // are we currently processing a request?
 	callback func(c net.Conn) // data callback
+
+	bytesRead    int64     // total bytes read from the connection so far
+	requestCount int       // requests read from the connection so far
+	idleSince    time.Time // when the connection most recently became idle; zero until its first idle state
+
+	minBytesPerSec int64     // throughput floor for the current state, 0 disables it
+	windowStart    time.Time // when the current state (StateHead/StateActive) began
+	windowBytes    int64     // bytes read since windowStart
+
+	// hijackedH2C is set once h2c.NewHandler hijacks this connection to
+	// upgrade it to cleartext HTTP/2 (see markH2CUpgrade). From that point
+	// net/http never calls ConnState for it again, so Read disengages all
+	// of rtConn's own state tracking; see isHTTP2Conn.
+	hijackedH2C bool
 }
 
 func (c *rtConn) Read(b []byte) (n int, err error) {
 	n, err = c.Conn.Read(b)
-	if n > 0 && !c.active {
-		c.callback(c)
+	if n > 0 && !c.hijackedH2C {
+		c.bytesRead += int64(n)
+		if !c.active {
+			c.active = true
+			c.requestCount++
+			c.callback(c)
+		}
+
+		c.windowBytes += int64(n)
+		c.checkThroughput()
 	}
 	return
 }
 
 func (c *rtConn) idle() {
 	c.active = false
+	c.idleSince = time.Now()
+}
+
+// SetReadDeadline overrides net.Conn's so that updateConnState's deadline
+// bookkeeping becomes a no-op once c is hijacked for h2c. http2.Server
+// reuses the same ConnState hook post-hijack, but the conn it passes isn't
+// reliably c itself: h2c.NewHandler may wrap c in an unexported bufConn
+// first (see configureHTTP2), which isHTTP2Conn can't see through, so
+// updateConnState can still believe it's dealing with a plain HTTP/1.1
+// conn and try to (re)arm a stale HeadReadTimeout/BodyReadTimeout deadline.
+// Since bufConn doesn't override SetReadDeadline, calls through it are
+// promoted straight to this method regardless, making it the one place
+// that reliably sees every deadline update meant for c.
+func (c *rtConn) SetReadDeadline(t time.Time) error {
+	if c.hijackedH2C {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// enterRateWindow resets the throughput tracking window for a new
+// StateHead or StateActive phase and selects the floor that applies to it.
+func (c *rtConn) enterRateWindow(state http.ConnState, headFloor, bodyFloor int64) {
+	c.windowStart = time.Now()
+	c.windowBytes = 0
+
+	switch state {
+	case StateHead:
+		c.minBytesPerSec = headFloor
+	case http.StateActive:
+		c.minBytesPerSec = bodyFloor
+	}
+}
+
+// slowlorisGracePeriod is how long a connection is given before its
+// throughput is measured against MinHeaderBytesPerSecond/MinBodyBytesPerSecond,
+// so that a fresh state transition isn't immediately judged against an
+// average computed over a near-zero time span.
+var slowlorisGracePeriod = time.Second
+
+// checkThroughput aborts the connection if, since entering the current
+// state, it has read data for longer than slowlorisGracePeriod at an
+// average rate below minBytesPerSec.
+func (c *rtConn) checkThroughput() {
+	if c.minBytesPerSec <= 0 {
+		return
+	}
+
+	elapsed := time.Since(c.windowStart)
+	if elapsed < slowlorisGracePeriod {
+		return
+	}
+
+	if float64(c.windowBytes)/elapsed.Seconds() < float64(c.minBytesPerSec) {
+		c.SetReadDeadline(time.Now())
+	}
 }
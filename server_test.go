@@ -3,15 +3,27 @@ package httpterm
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
+	"math/big"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
 func assertTimeout(elapsed, expected time.Duration) error {
@@ -76,6 +88,25 @@ func httpGet(c net.Conn) (data []byte, err error) {
 	return
 }
 
+// httpGetKeepAlive is like httpGet, but sends a Host header so the request
+// is valid HTTP/1.1 and the server doesn't respond with a "Connection:
+// close" 400 and tear down the connection, letting a caller reuse c for
+// more than one request.
+func httpGetKeepAlive(c net.Conn) (err error) {
+	if _, err = c.Write([]byte("GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n")); err != nil {
+		return
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	_, err = ioutil.ReadAll(resp.Body)
+	return
+}
+
 func TestNewConnectionIdleTimeout(t *testing.T) {
 	t.Parallel()
 
@@ -425,10 +456,141 @@ func TestClose_activeAfterClose(t *testing.T) {
 	<-done
 }
 
-func TestClose_signal(t *testing.T) {
+func TestShutdown_noConns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan bool)
+
+	var s Server
+	s.IdleTimeout = 5 * time.Second
+
+	go func() {
+		pending, err := s.Serve(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-pending
+		done <- true
+	}()
+
+	c, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// Give the server a moment to notice the closed connection before we
+	// ask it to shut down, so conns is empty and Shutdown returns promptly.
+	time.Sleep(100 * time.Millisecond)
+
+	if err = s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	<-done
+}
+
+func TestShutdown_waitsForActive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	serving := make(chan bool)
+	release := make(chan bool)
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		serving <- true
+		<-release
+	})
+
+	var s Server
+	s.Handler = handler
+
+	go func() {
+		s.Serve(l)
+	}()
+
+	c, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = c.Write([]byte("GET /index.html HTTP/1.1\nHost: test\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-serving
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+
+	// Shutdown must not return while the handler is still running.
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned early: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	release <- true
+
+	if err := <-shutdownErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdown_deadlineExceeded(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	serving := make(chan bool)
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		serving <- true
+		select {}
+	})
+
+	var s Server
+	s.Handler = handler
+
+	go func() {
+		s.Serve(l)
+	}()
+
+	c, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = c.Write([]byte("GET /index.html HTTP/1.1\nHost: test\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-serving
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestShutdown_alreadyClosing(t *testing.T) {
 	var s Server
 	s.Addr = "127.0.0.1:0"
-	s.CloseOnSignal = true
 
 	done := make(chan bool)
 
@@ -442,7 +604,740 @@ func TestClose_signal(t *testing.T) {
 	}()
 
 	time.Sleep(time.Second)
-	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	s.Close()
+	<-done
+
+	if err := s.Shutdown(context.Background()); err != ErrClosing {
+		t.Fatal("Expected ErrClosing, got:", err)
+	}
+}
+
+func TestIsUnixAddr(t *testing.T) {
+	cases := []struct {
+		addr string
+		want bool
+	}{
+		{"/var/run/app.sock", true},
+		{"unix:/var/run/app.sock", true},
+		{"unix:app.sock", true},
+		{":http", false},
+		{"127.0.0.1:8080", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		if got := isUnixAddr(c.addr); got != c.want {
+			t.Errorf("isUnixAddr(%q) = %v, want %v", c.addr, got, c.want)
+		}
+	}
+}
+
+func TestListenAndServeUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpterm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sockPath := filepath.Join(dir, "httpterm.sock")
+
+	var s Server
+	s.Addr = "unix:" + sockPath
+
+	done := make(chan bool)
+
+	go func() {
+		pending, err := s.ListenAndServe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-pending
+		done <- true
+	}()
+
+	// Wait for the socket file to appear.
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(sockPath); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
 
+	s.Close()
 	<-done
 }
+
+func TestListenFDs_noEnv(t *testing.T) {
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	if _, err := ListenFDs(); err == nil {
+		t.Fatal("expected an error when LISTEN_PID/LISTEN_FDS are unset")
+	}
+}
+
+// TestFanInListenerMerges checks the basic multiplexing fanInListener
+// exists for: a connection accepted on either underlying listener comes
+// out of the merged Accept.
+func TestFanInListenerMerges(t *testing.T) {
+	l1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+
+	fi := newFanInListener([]net.Listener{l1, l2})
+	defer fi.Close()
+
+	for _, addr := range []string{l1.Addr().String(), l2.Addr().String()} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		accepted, err := fi.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted.Close()
+	}
+}
+
+// TestFanInListenerOneListenerErroringClosesTheOthers guards against a
+// goroutine and socket leak: if one of several listeners fails on its own
+// (e.g. an inherited fd closed out from under it), independently of
+// fanInListener.Close, every other listener's acceptLoop must be torn down
+// too, since the merged Accept has already reported the one terminal error
+// rtListener.acceptLoop expects and will stop reading l.accepted for good.
+// Without that, a surviving listener's acceptLoop goroutine blocks forever
+// on its next accepted connection, and its listener is never closed.
+func TestFanInListenerOneListenerErroringClosesTheOthers(t *testing.T) {
+	l1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+
+	fi := newFanInListener([]net.Listener{l1, l2})
+	defer fi.Close()
+
+	// Simulate l1 failing independently of fi.Close, e.g. its underlying fd
+	// being closed out from under it by something other than this package.
+	l1.Close()
+
+	if _, err := fi.Accept(); err == nil {
+		t.Fatal("expected an error from the failed listener")
+	}
+
+	select {
+	case <-fi.done:
+	case <-time.After(time.Second):
+		t.Fatal("fanInListener.done was never closed after one listener errored independently")
+	}
+
+	// l2's acceptLoop should have been torn down along with l1's, closing
+	// l2 in the process; a new connection to it must fail to dial.
+	if _, err := net.Dial("tcp", l2.Addr().String()); err == nil {
+		t.Error("expected l2 to be closed once l1 errored independently")
+	}
+}
+
+func TestConnStateFunc(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var s Server
+
+	type observed struct {
+		info ConnInfo
+	}
+	seen := make(chan observed, 2)
+	s.ConnStateFunc = func(c net.Conn, state http.ConnState, info ConnInfo) {
+		seen <- observed{info}
+	}
+
+	go func() {
+		s.Serve(l)
+	}()
+	defer s.Close()
+
+	c, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := httpGetKeepAlive(c); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case o := <-seen:
+		if o.info.RequestCount != 1 {
+			t.Errorf("RequestCount = %d, want 1", o.info.RequestCount)
+		}
+		if o.info.BytesRead == 0 {
+			t.Error("BytesRead = 0, want > 0")
+		}
+		if o.info.RemoteAddr == nil {
+			t.Error("RemoteAddr = nil")
+		}
+		if o.info.IdleDuration != 0 {
+			t.Errorf("IdleDuration = %v, want 0 for a connection's first request", o.info.IdleDuration)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ConnStateFunc was not called")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := httpGetKeepAlive(c); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case o := <-seen:
+		if o.info.RequestCount != 2 {
+			t.Errorf("RequestCount = %d, want 2", o.info.RequestCount)
+		}
+		if o.info.IdleDuration == 0 {
+			t.Error("IdleDuration = 0, want > 0 for a connection's second request")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ConnStateFunc was not called")
+	}
+}
+
+func TestMinHeaderBytesPerSecond(t *testing.T) {
+	oldGrace := slowlorisGracePeriod
+	slowlorisGracePeriod = 100 * time.Millisecond
+	defer func() { slowlorisGracePeriod = oldGrace }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var s Server
+	s.HeadReadTimeout = 10 * time.Second
+	s.MinHeaderBytesPerSecond = 1000
+
+	go func() {
+		s.Serve(l)
+	}()
+	defer s.Close()
+
+	c, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write([]byte("G")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sleep well past the grace period while trickling a single byte at a
+	// time, far below the configured floor.
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := c.Write([]byte("E")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection should be aborted well before the 10s HeadReadTimeout,
+	// closed by the server once it notices the throughput is below floor.
+	// As with HeadReadTimeout, the aborted header read gets no response.
+	data, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("received unexpected data before the connection closed: %q", data)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("connection aborted too slowly: %s", elapsed)
+	}
+}
+
+func TestMinBodyBytesPerSecond(t *testing.T) {
+	oldGrace := slowlorisGracePeriod
+	slowlorisGracePeriod = 100 * time.Millisecond
+	defer func() { slowlorisGracePeriod = oldGrace }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	bodyErr := make(chan error, 1)
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		bodyErr <- err
+	})
+
+	var s Server
+	s.Handler = handler
+	s.BodyReadTimeout = 10 * time.Second
+	s.MinBodyBytesPerSecond = 1000
+
+	go func() {
+		s.Serve(l)
+	}()
+	defer s.Close()
+
+	c, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write([]byte("POST /index.html HTTP/1.1\nHost: test\nContent-Length: 16\n\nd")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sleep well past the grace period while trickling a single body byte,
+	// far below the configured floor.
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := c.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-bodyErr; err == nil {
+		t.Fatal("expected body read to fail for insufficient throughput")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("body read aborted too slowly: %s", elapsed)
+	}
+}
+
+func TestClose_signal(t *testing.T) {
+	var s Server
+	s.Addr = "127.0.0.1:0"
+	s.CloseOnSignal = true
+
+	done := make(chan bool)
+
+	go func() {
+		pending, err := s.ListenAndServe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-pending
+		done <- true
+	}()
+
+	time.Sleep(time.Second)
+	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+
+	<-done
+}
+
+func TestMaxConcurrentConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var s Server
+	s.MaxConcurrentConnections = 1
+	s.RejectResponse = []byte("rejected")
+
+	go func() {
+		s.Serve(l)
+	}()
+	defer s.Close()
+
+	c1, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	// Give the server a moment to admit c1 before dialing c2, so c2 is
+	// guaranteed to be over the limit.
+	time.Sleep(100 * time.Millisecond)
+
+	c2, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := ioutil.ReadAll(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "rejected" {
+		t.Fatalf("data = %q, want %q", data, "rejected")
+	}
+
+	if _, err := httpGet(c1); err != nil {
+		t.Fatalf("c1 should still be served: %s", err)
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var s Server
+	s.MaxConnectionsPerIP = 1
+
+	go func() {
+		s.Serve(l)
+	}()
+	defer s.Close()
+
+	c1, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	c2, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := ioutil.ReadAll(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("expected no data from rejected connection, got %q", data)
+	}
+}
+
+func TestAcceptWaitAdmitsFreedSlot(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var s Server
+	s.MaxConcurrentConnections = 1
+	s.AcceptWait = time.Second
+
+	go func() {
+		s.Serve(l)
+	}()
+	defer s.Close()
+
+	c1, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	c2, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	// Free up the slot c1 holds; c2's admission should be waiting within
+	// AcceptWait and pick it up rather than being rejected.
+	c1.Close()
+
+	if _, err := httpGet(c2); err != nil {
+		t.Fatalf("c2 should be admitted once c1's slot frees up: %s", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var s Server
+
+	go func() {
+		s.Serve(l)
+	}()
+	defer s.Close()
+
+	c, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Give the server a moment to admit and register the connection before
+	// inspecting Stats.
+	time.Sleep(100 * time.Millisecond)
+
+	stats := s.Stats(0)
+	if stats.Total != 1 {
+		t.Fatalf("Total = %d, want 1", stats.Total)
+	}
+	if len(stats.TopIPs) != 1 || stats.TopIPs[0].Count != 1 {
+		t.Fatalf("TopIPs = %+v, want one entry with Count 1", stats.TopIPs)
+	}
+}
+
+// selfSignedCert generates an in-memory, localhost-only certificate for
+// TLS tests, advertising both ALPN protocols a client might request.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestEnableHTTP2TLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	s.EnableHTTP2 = true
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}
+
+	go func() {
+		s.Serve(tls.NewListener(l, s.TLSConfig))
+	}()
+	defer s.Close()
+
+	// An HTTP/2-only client, so the request succeeds only if the server
+	// negotiates "h2" over ALPN.
+	transport := &http2.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get("https://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("ProtoMajor = %d, want 2", resp.ProtoMajor)
+	}
+
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnableHTTP2H2C(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	s.EnableHTTP2 = true
+
+	go func() {
+		s.Serve(l)
+	}()
+	defer s.Close()
+
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get("http://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("ProtoMajor = %d, want 2", resp.ProtoMajor)
+	}
+
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestEnableHTTP2H2CSurvivesIdleGap guards against a stale pre-upgrade
+// rtConn deadline killing a long-lived h2c connection: once h2c.NewHandler
+// hijacks the connection, net/http stops calling ConnState, so whatever
+// HeadReadTimeout/BodyReadTimeout deadline rtConn set for the upgrade
+// request must not still be enforced against later requests on the same
+// connection (see isHTTP2Conn, updateConnState). A short BodyReadTimeout
+// and an idle gap well past it between two requests reproduces the bug:
+// without the fix, the connection is killed and http2.Transport silently
+// redials for the second request.
+func TestEnableHTTP2H2CSurvivesIdleGap(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	s.EnableHTTP2 = true
+	s.BodyReadTimeout = 50 * time.Millisecond
+
+	go func() {
+		s.Serve(l)
+	}()
+	defer s.Close()
+
+	var dials int32
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("ProtoMajor = %d, want 2", resp.ProtoMajor)
+		}
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		time.Sleep(3 * s.BodyReadTimeout)
+	}
+
+	if got := atomic.LoadInt32(&dials); got != 1 {
+		t.Errorf("dials = %d, want 1 (stale BodyReadTimeout deadline must not kill an idle h2c connection)", got)
+	}
+}
+
+// TestEnableHTTP2StalledHandshakeDoesNotBlockAccept guards against the ALPN
+// handshake rtListener runs for EnableHTTP2 serializing with accepting
+// other connections: a client that opens a TLS connection and never sends
+// its ClientHello must not be able to starve every other connection on the
+// listener.
+func TestEnableHTTP2StalledHandshakeDoesNotBlockAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s Server
+	s.EnableHTTP2 = true
+	s.HandshakeTimeout = 50 * time.Millisecond
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}
+
+	go func() {
+		s.Serve(tls.NewListener(l, s.TLSConfig))
+	}()
+	defer s.Close()
+
+	// Open a raw TCP connection and never send a ClientHello.
+	stalled, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := client.Get("https://" + l.Addr().String() + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("legitimate request blocked by a stalled TLS handshake on another connection")
+	}
+}